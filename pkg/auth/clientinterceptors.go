@@ -20,6 +20,8 @@ import (
 	"context"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type WrappedClientStream struct {
@@ -34,14 +36,21 @@ func (w *WrappedClientStream) SendMsg(m interface{}) error {
 	return w.ClientStream.SendMsg(m)
 }
 
-func ClientStreamInterceptor(token string) func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, grpc.Streamer, ...grpc.CallOption) (grpc.ClientStream, error) {
+// ClientStreamInterceptor attaches the credentials obtained from src to every
+// streaming RPC that requires auth. If the stream can't even be established
+// because the server rejected the token, and src knows how to refresh itself,
+// one retry is attempted with the refreshed token.
+func ClientStreamInterceptor(src TokenSource) func(context.Context, *grpc.StreamDesc, *grpc.ClientConn, string, grpc.Streamer, ...grpc.CallOption) (grpc.ClientStream, error) {
 	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
-		if hasAuth(method) {
-			opts = append(opts, grpc.PerRPCCredentials(TokenAuth{
-				Token: token,
-			}))
+		if !hasAuth(method) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+
+		callOpts := append(opts, grpc.PerRPCCredentials(TokenAuth{Source: src}))
+		s, err := streamer(ctx, desc, cc, method, callOpts...)
+		if err != nil && retryWithRefresh(ctx, src, err) {
+			s, err = streamer(ctx, desc, cc, method, callOpts...)
 		}
-		s, err := streamer(ctx, desc, cc, method, opts...)
 		if err != nil {
 			return nil, err
 		}
@@ -49,27 +58,70 @@ func ClientStreamInterceptor(token string) func(context.Context, *grpc.StreamDes
 	}
 }
 
-func ClientUnaryInterceptor(token string) func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, grpc.UnaryInvoker, ...grpc.CallOption) error {
+// ClientUnaryInterceptor attaches the credentials obtained from src to every
+// unary RPC that requires auth, retrying once if the server rejects the
+// token and src supports refreshing it.
+func ClientUnaryInterceptor(src TokenSource) func(context.Context, string, interface{}, interface{}, *grpc.ClientConn, grpc.UnaryInvoker, ...grpc.CallOption) error {
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
-		if hasAuth(method) {
-			opts = append(opts, grpc.PerRPCCredentials(TokenAuth{
-				Token: token,
-			}))
+		if !hasAuth(method) {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+
+		callOpts := append(opts, grpc.PerRPCCredentials(TokenAuth{Source: src}))
+		err := invoker(ctx, method, req, reply, cc, callOpts...)
+		if err != nil && retryWithRefresh(ctx, src, err) {
+			err = invoker(ctx, method, req, reply, cc, callOpts...)
 		}
-		return invoker(ctx, method, req, reply, cc, opts...)
+		return err
 	}
 }
 
+// retryWithRefresh asks src to refresh itself when err is an Unauthenticated
+// status and src is a Refresher. It reports whether the retry should happen.
+func retryWithRefresh(ctx context.Context, src TokenSource, err error) bool {
+	if status.Code(err) != codes.Unauthenticated {
+		return false
+	}
+	r, ok := src.(Refresher)
+	if !ok {
+		return false
+	}
+	_, rerr := r.Refresh(ctx)
+	return rerr == nil
+}
+
+// TokenSource abstracts where a client's auth token comes from, so long-lived
+// connections can pick up rotated credentials without being rebuilt.
+type TokenSource interface {
+	// Token returns the token to present on the next RPC.
+	Token(ctx context.Context) (string, error)
+	// RequireTransportSecurity reports whether this source demands the
+	// channel be encrypted (e.g. a bearer token that must never travel in
+	// the clear).
+	RequireTransportSecurity() bool
+}
+
+// Refresher is implemented by token sources that can fetch a new token on
+// demand, typically after the server rejected the previous one.
+type Refresher interface {
+	Refresh(ctx context.Context) (string, error)
+}
+
+// TokenAuth implements credentials.PerRPCCredentials over a TokenSource.
 type TokenAuth struct {
-	Token string
+	Source TokenSource
 }
 
 func (t TokenAuth) GetRequestMetadata(ctx context.Context, in ...string) (map[string]string, error) {
+	token, err := t.Source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return map[string]string{
-		"authorization": "Bearer " + t.Token,
+		"authorization": "Bearer " + token,
 	}, nil
 }
 
-func (TokenAuth) RequireTransportSecurity() bool {
-	return false
+func (t TokenAuth) RequireTransportSecurity() bool {
+	return t.Source.RequireTransportSecurity()
 }
@@ -0,0 +1,85 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type fakeRefreshSource struct {
+	token      string
+	refreshed  bool
+	refreshErr error
+}
+
+func (f *fakeRefreshSource) Token(ctx context.Context) (string, error) { return f.token, nil }
+func (f *fakeRefreshSource) RequireTransportSecurity() bool            { return false }
+
+func (f *fakeRefreshSource) Refresh(ctx context.Context) (string, error) {
+	f.refreshed = true
+	if f.refreshErr != nil {
+		return "", f.refreshErr
+	}
+	f.token = "refreshed"
+	return f.token, nil
+}
+
+func TestRetryWithRefresh_RefreshesOnUnauthenticated(t *testing.T) {
+	src := &fakeRefreshSource{token: "stale"}
+	err := status.Error(codes.Unauthenticated, "bad token")
+
+	if !retryWithRefresh(context.Background(), src, err) {
+		t.Fatal("expected retry to be signalled")
+	}
+	if !src.refreshed {
+		t.Fatal("expected Refresh to be called")
+	}
+	if src.token != "refreshed" {
+		t.Fatalf("expected token to be refreshed, got %q", src.token)
+	}
+}
+
+func TestRetryWithRefresh_IgnoresOtherErrors(t *testing.T) {
+	src := &fakeRefreshSource{token: "stale"}
+	if retryWithRefresh(context.Background(), src, errors.New("boom")) {
+		t.Fatal("expected no retry for a non-Unauthenticated error")
+	}
+	if src.refreshed {
+		t.Fatal("Refresh should not have been called")
+	}
+}
+
+func TestRetryWithRefresh_NoRetryWithoutRefresher(t *testing.T) {
+	src := NewStaticTokenSource("tok", false)
+	err := status.Error(codes.Unauthenticated, "bad token")
+	if retryWithRefresh(context.Background(), src, err) {
+		t.Fatal("a source without Refresh should never signal retry")
+	}
+}
+
+func TestRetryWithRefresh_NoRetryOnRefreshError(t *testing.T) {
+	src := &fakeRefreshSource{token: "stale", refreshErr: errors.New("kms down")}
+	err := status.Error(codes.Unauthenticated, "bad token")
+	if retryWithRefresh(context.Background(), src, err) {
+		t.Fatal("expected no retry when Refresh itself fails")
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/codenotary/immudb/pkg/api/schema"
+	"github.com/codenotary/merkletree"
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+// Partial implementation: this file provides the Store-side primitives
+// (BackupTo/RestoreFrom) that a remote Backup/Restore RPC would sit on top
+// of, plus BackupSender/RestoreReceiver interfaces shaped to match the
+// generated gRPC stream types. It does NOT add the gRPC service itself -
+// there is no .proto addition, no generated ImmuService_Backup/RestoreServer,
+// and no server registration, so nothing here is remote-reachable yet. Do
+// not treat "streaming backup/restore RPC" as done until that wiring lands.
+
+// restoreTmpSuffix/restoreBackupSuffix name the sibling directories used by
+// RestoreFrom: batches are loaded and verified in <dataDir>.restore-tmp,
+// never touching the live store, and the directory being replaced is kept
+// at <dataDir>.restore-old until the swap is confirmed.
+const (
+	restoreTmpSuffix    = ".restore-tmp"
+	restoreBackupSuffix = ".restore-old"
+)
+
+// BackupSchemaVersion identifies the wire format of the header exchanged at
+// the start of a Backup/Restore stream. Bump it whenever BackupHeader or the
+// KVList framing changes in an incompatible way.
+const BackupSchemaVersion = 1
+
+var (
+	// ErrNonEmptyStore is returned by RestoreFrom when the target store
+	// already holds data and the caller didn't opt in with force.
+	ErrNonEmptyStore = errors.New("store: refusing to restore into a non-empty store, use --force to override")
+
+	// ErrRootMismatch is returned when the root computed after a restore
+	// doesn't match the root hash advertised in the stream's header.
+	ErrRootMismatch = errors.New("store: restored root hash does not match backup header")
+)
+
+// BackupHeader is sent once, before any KVList batch, so the receiving side
+// knows what it's restoring and can detect a truncated or corrupted
+// transfer once loading completes.
+type BackupHeader struct {
+	SchemaVersion uint32
+	TreeWidth     uint64
+	RootHash      []byte
+}
+
+// BackupSender is the subset of the generated gRPC server-stream needed to
+// push a backup to a client (satisfied by ImmuService_BackupServer).
+//
+// This and RestoreReceiver describe the shape of the generated
+// ImmuService_Backup/RestoreServer streams so BackupTo/RestoreFrom can be
+// unit-tested and called without depending on the generated code; wiring an
+// actual Backup/Restore RPC into the ImmuService proto and server is tracked
+// as follow-up work, not part of this change.
+type BackupSender interface {
+	Send(*pb.KVList) error
+}
+
+// RestoreReceiver is the subset of the generated gRPC stream needed to pull a
+// restore from a client (satisfied by ImmuService_RestoreServer).
+type RestoreReceiver interface {
+	Recv() (*pb.KVList, error)
+}
+
+// Header builds the BackupHeader describing the current state of the store,
+// to be sent before streaming starts.
+func (t *Store) Header() (BackupHeader, error) {
+	root, err := t.CurrentRoot()
+	if err != nil {
+		return BackupHeader{}, err
+	}
+	return BackupHeader{
+		SchemaVersion: BackupSchemaVersion,
+		TreeWidth:     t.tree.Width(),
+		RootHash:      root.Root,
+	}, nil
+}
+
+// BackupTo streams the store's content to sender, resuming from
+// resumeFromTs when it is non-zero: a client that lost its connection mid
+// transfer reconnects and reports the last timestamp it durably applied, and
+// the server seeks the underlying Badger stream there instead of starting
+// over, so multi-GB stores can survive a network hiccup.
+func (t *Store) BackupTo(ctx context.Context, sender BackupSender, resumeFromTs uint64) error {
+	defer t.tree.Unlock()
+	t.tree.Lock()
+	t.tree.flush()
+
+	stream := t.db.NewStreamAt(t.tree.w)
+	stream.NumGo = 16
+	stream.LogPrefix = "Badger.Streaming"
+	if resumeFromTs > 0 {
+		stream.SinceTs = resumeFromTs
+	}
+
+	stream.Send = func(list *pb.KVList) error {
+		return sender.Send(list)
+	}
+
+	return stream.Orchestrate(ctx)
+}
+
+// RestoreFrom consumes batches from receiver and loads them into the store.
+// force allows restoring into a store that already holds data; without it,
+// RestoreFrom refuses to touch a non-empty store.
+//
+// Batches are loaded into a staging DB in a sibling directory first, never
+// touching the live store. Once the stream ends, the staged tree is loaded
+// and its root checked against header: only if it matches does RestoreFrom
+// swap the staging directory into place and reopen t.db against it. A
+// truncated or tampered transfer is therefore caught and discarded before a
+// single byte of bad data ever reaches the store the caller is about to
+// trust, instead of being found after the fact. lastAppliedTs is the highest
+// entry version received. When RestoreFrom fails, everything staged is
+// discarded, and a later call starts again from an empty staging DB.
+func (t *Store) RestoreFrom(receiver RestoreReceiver, header BackupHeader, force bool) (lastAppliedTs uint64, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.tree.Lock()
+	defer t.tree.Unlock()
+
+	if !force && t.tree.Width() > 0 {
+		return 0, ErrNonEmptyStore
+	}
+
+	stagingDir := t.dataDir + restoreTmpSuffix
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return 0, err
+	}
+
+	stagingOpt := t.badgerOpts
+	stagingOpt.Dir = stagingDir
+	stagingOpt.ValueDir = stagingDir
+
+	staging, err := badger.OpenManaged(stagingOpt)
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingDir) // no-op once the swap below has moved it
+
+	ldr := staging.NewKVLoader(16)
+	for {
+		list, rerr := receiver.Recv()
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			staging.Close()
+			return lastAppliedTs, rerr
+		}
+
+		for _, kv := range list.Kv {
+			if err := ldr.Set(kv); err != nil {
+				staging.Close()
+				return lastAppliedTs, err
+			}
+			if kv.Version > lastAppliedTs {
+				lastAppliedTs = kv.Version
+			}
+		}
+	}
+
+	if err := ldr.Finish(); err != nil {
+		staging.Close()
+		return lastAppliedTs, err
+	}
+
+	stagingTree := newTreeStore(staging, 750_000, t.log)
+	stagingTree.loadTreeState()
+
+	root := &schema.Root{}
+	w := stagingTree.Width()
+	if w > 0 {
+		h := merkletree.Root(stagingTree)
+		root.Root = h[:]
+		root.Index = w - 1
+	}
+	if w != header.TreeWidth || !bytes.Equal(root.Root, header.RootHash) {
+		stagingTree.Close()
+		staging.Close()
+		return lastAppliedTs, ErrRootMismatch
+	}
+
+	stagingTree.Close()
+	if err := staging.Close(); err != nil {
+		return lastAppliedTs, err
+	}
+
+	backupDir := t.dataDir + restoreBackupSuffix
+	if err := os.RemoveAll(backupDir); err != nil {
+		return lastAppliedTs, err
+	}
+	if err := t.db.Close(); err != nil {
+		return lastAppliedTs, err
+	}
+	if err := os.Rename(t.dataDir, backupDir); err != nil {
+		return lastAppliedTs, err
+	}
+	if err := os.Rename(stagingDir, t.dataDir); err != nil {
+		os.Rename(backupDir, t.dataDir) // best-effort rollback
+		return lastAppliedTs, err
+	}
+
+	reopenOpt := t.badgerOpts
+	reopenOpt.Dir = t.dataDir
+	reopenOpt.ValueDir = t.dataDir
+	db, err := badger.OpenManaged(reopenOpt)
+	if err != nil {
+		return lastAppliedTs, err
+	}
+
+	t.db = db
+	t.tree = newTreeStore(db, 750_000, t.log)
+	t.tree.loadTreeState()
+
+	return lastAppliedTs, os.RemoveAll(backupDir)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/codenotary/immudb/pkg/api/schema"
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+func newPlainTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(DefaultOptions(t.TempDir(), nilLogger{}))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+type fakeBackupSender struct {
+	lists []*pb.KVList
+}
+
+func (f *fakeBackupSender) Send(list *pb.KVList) error {
+	f.lists = append(f.lists, list)
+	return nil
+}
+
+func (f *fakeBackupSender) kvCount() int {
+	n := 0
+	for _, l := range f.lists {
+		n += len(l.Kv)
+	}
+	return n
+}
+
+type fakeRestoreReceiver struct {
+	lists []*pb.KVList
+	i     int
+}
+
+func (f *fakeRestoreReceiver) Recv() (*pb.KVList, error) {
+	if f.i >= len(f.lists) {
+		return nil, io.EOF
+	}
+	l := f.lists[f.i]
+	f.i++
+	return l, nil
+}
+
+func TestRestoreFrom_RefusesNonEmptyStoreWithoutForce(t *testing.T) {
+	s := newPlainTestStore(t)
+	if _, err := s.Set(schema.KeyValue{Key: []byte("k"), Value: []byte("v")}); err != nil {
+		t.Fatalf("seed write: %v", err)
+	}
+
+	if _, err := s.RestoreFrom(&fakeRestoreReceiver{}, BackupHeader{}, false); err != ErrNonEmptyStore {
+		t.Fatalf("expected ErrNonEmptyStore, got %v", err)
+	}
+}
+
+func TestRestoreFrom_RejectsRootMismatch(t *testing.T) {
+	src := newPlainTestStore(t)
+	if _, err := src.Set(schema.KeyValue{Key: []byte("k1"), Value: []byte("v1")}); err != nil {
+		t.Fatalf("seed write: %v", err)
+	}
+
+	header, err := src.Header()
+	if err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	header.RootHash = append([]byte{}, header.RootHash...)
+	header.RootHash[0] ^= 0xFF // corrupt the advertised root
+
+	sender := &fakeBackupSender{}
+	if err := src.BackupTo(context.Background(), sender, 0); err != nil {
+		t.Fatalf("backup: %v", err)
+	}
+
+	dst := newPlainTestStore(t)
+	_, err = dst.RestoreFrom(&fakeRestoreReceiver{lists: sender.lists}, header, true)
+	if err != ErrRootMismatch {
+		t.Fatalf("expected ErrRootMismatch, got %v", err)
+	}
+
+	// a rejected restore must not have touched the destination store.
+	if dst.tree.Width() != 0 {
+		t.Fatalf("expected destination store to remain empty after a rejected restore, width=%d", dst.tree.Width())
+	}
+}
+
+func TestBackupTo_ResumesFromSinceTs(t *testing.T) {
+	s := newPlainTestStore(t)
+
+	if _, err := s.Set(schema.KeyValue{Key: []byte("k1"), Value: []byte("v1")}); err != nil {
+		t.Fatalf("seed write 1: %v", err)
+	}
+	idx2, err := s.Set(schema.KeyValue{Key: []byte("k2"), Value: []byte("v2")})
+	if err != nil {
+		t.Fatalf("seed write 2: %v", err)
+	}
+
+	full := &fakeBackupSender{}
+	if err := s.BackupTo(context.Background(), full, 0); err != nil {
+		t.Fatalf("full backup: %v", err)
+	}
+	if full.kvCount() == 0 {
+		t.Fatal("expected a full backup to send at least one entry")
+	}
+
+	// resuming from just past the last entry's timestamp should send
+	// nothing new, simulating a client reconnecting after everything it
+	// sent was already durably applied.
+	resumeFromTs := idx2.Index + 2
+	resumed := &fakeBackupSender{}
+	if err := s.BackupTo(context.Background(), resumed, resumeFromTs); err != nil {
+		t.Fatalf("resumed backup: %v", err)
+	}
+
+	if resumed.kvCount() >= full.kvCount() {
+		t.Fatalf("expected resuming from ts=%d to send fewer entries than a full backup (%d full vs %d resumed)",
+			resumeFromTs, full.kvCount(), resumed.kvCount())
+	}
+}
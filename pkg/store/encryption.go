@@ -0,0 +1,223 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/dgraph-io/badger/v2/pb"
+)
+
+// rekeyTmpSuffix/rekeyBackupSuffix name the sibling directories used while
+// rotating: the new key's SSTables/vlog are built up in <dataDir>.rekey-tmp,
+// and the directory being replaced is kept at <dataDir>.rekey-old until the
+// swap is confirmed, so a crash mid-rotation never leaves both copies missing.
+const (
+	rekeyTmpSuffix    = ".rekey-tmp"
+	rekeyBackupSuffix = ".rekey-old"
+)
+
+var (
+	// ErrMissingEncryptionKey is returned by a KeySource when no key is
+	// available (e.g. the env var isn't set).
+	ErrMissingEncryptionKey = errors.New("store: missing encryption key")
+)
+
+const keyringFile = "KEYRING"
+
+// keyring is the small on-disk record of key identities, kept in the data
+// directory as the KEYRING file. It never stores key material, only IDs, so it is safe to
+// read back without decrypting anything.
+type keyring struct {
+	CurrentID  string `json:"currentId"`
+	PreviousID string `json:"previousId,omitempty"`
+}
+
+func keyID(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(key)
+	return fmt.Sprintf("%x", sum)[:16]
+}
+
+func loadKeyring(dataDir string) (*keyring, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dataDir, keyringFile))
+	if err != nil {
+		return &keyring{}, nil
+	}
+	kr := &keyring{}
+	if err := json.Unmarshal(b, kr); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *keyring) save(dataDir string) error {
+	b, err := json.Marshal(kr)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dataDir, keyringFile), b, 0600)
+}
+
+// RotateEncryptionKey re-encrypts the store under newKey, replacing whatever
+// key is currently active. Badger fixes EncryptionKey at Open() time, so
+// there is no in-place rekey: this builds a brand new DB under newKey in a
+// sibling directory, streams every entry from the live (still old-keyed)
+// db.db into it, then swaps directories and reopens t.db against the
+// rewritten files. t.tree.Lock is held for the whole operation - the same
+// lock Set/SetBatch/Reference/ZAdd block on via treeStore.NewEntry, and the
+// one Dump already holds for its entire streaming run - so this blocks
+// writes for the duration of the rotation. Key lookups that read t.db
+// directly (Get) keep being served from the original DB, which stays open
+// and untouched, right up until the directory swap. Reads that go through
+// the tree (CurrentRoot, lookups by index) take t.tree.RLock and so wait
+// until the rotation has finished.
+//
+// t.wg.Wait must happen before t.tree.Lock, not after: an in-flight
+// async-commit write's callback calls t.tree.Commit before t.wg.Done (see
+// Set/SetBatch/Reference/ZAdd), so waiting on t.wg while already holding
+// t.tree.Lock would deadlock waiting on a callback that can never acquire
+// the lock it needs. FlushToDisk follows the same ordering for the same
+// reason.
+func (t *Store) RotateEncryptionKey(newKey []byte) error {
+	t.Lock()
+	defer t.Unlock()
+
+	t.wg.Wait()
+
+	t.tree.Lock()
+	defer t.tree.Unlock()
+
+	t.tree.flush()
+
+	kr, err := loadKeyring(t.dataDir)
+	if err != nil {
+		return err
+	}
+
+	tmpDir := t.dataDir + rekeyTmpSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+
+	newOpt := t.badgerOpts
+	newOpt.Dir = tmpDir
+	newOpt.ValueDir = tmpDir
+	newOpt.EncryptionKey = newKey
+	newOpt.IndexCacheSize = defaultIndexCacheSize
+
+	newDB, err := badger.OpenManaged(newOpt)
+	if err != nil {
+		return err
+	}
+
+	if err := copyInto(t.db, t.tree.w, newDB); err != nil {
+		newDB.Close()
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	if err := newDB.Close(); err != nil {
+		os.RemoveAll(tmpDir)
+		return err
+	}
+
+	backupDir := t.dataDir + rekeyBackupSuffix
+	if err := os.RemoveAll(backupDir); err != nil {
+		return err
+	}
+	if err := t.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(t.dataDir, backupDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, t.dataDir); err != nil {
+		// best-effort rollback so the store isn't left unopenable
+		os.Rename(backupDir, t.dataDir)
+		return err
+	}
+
+	reopenOpt := newOpt
+	reopenOpt.Dir = t.dataDir
+	reopenOpt.ValueDir = t.dataDir
+	db, err := badger.OpenManaged(reopenOpt)
+	if err != nil {
+		return err
+	}
+
+	t.db = db
+	t.tree = newTreeStore(db, 750_000, t.log)
+	t.tree.loadTreeState()
+	t.badgerOpts = reopenOpt
+	t.encryptionKey = newKey
+
+	kr.PreviousID = kr.CurrentID
+	kr.CurrentID = keyID(newKey)
+	if err := kr.save(t.dataDir); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(backupDir)
+}
+
+// copyInto streams every entry from src, as of readTs, into dst via the
+// managed KV loader - the same batched transaction path Store.Dump/Restore
+// already use for whole-store transfers.
+func copyInto(src *badger.DB, readTs uint64, dst *badger.DB) error {
+	stream := src.NewStreamAt(readTs)
+	stream.NumGo = 16
+	stream.LogPrefix = "Badger.KeyRotation"
+
+	kvChan := make(chan *pb.KVList)
+	stream.Send = func(list *pb.KVList) error {
+		kvChan <- list
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ldr := dst.NewKVLoader(16)
+		for list := range kvChan {
+			for _, kv := range list.Kv {
+				if err := ldr.Set(kv); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+		done <- ldr.Finish()
+	}()
+
+	streamErr := stream.Orchestrate(context.Background())
+	close(kvChan)
+	if streamErr != nil {
+		<-done
+		return streamErr
+	}
+	return <-done
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/codenotary/immudb/pkg/api/schema"
+)
+
+func newTestStoreForRotation(t *testing.T) *Store {
+	t.Helper()
+	opts := DefaultOptions(t.TempDir(), nilLogger{}).
+		WithKeySource(NewStaticKeySource(bytes.Repeat([]byte{0x01}, 16)))
+	s, err := Open(opts)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRotateEncryptionKey_HappyPath(t *testing.T) {
+	s := newTestStoreForRotation(t)
+
+	if _, err := s.Set(schema.KeyValue{Key: []byte("k1"), Value: []byte("v1")}); err != nil {
+		t.Fatalf("seed write: %v", err)
+	}
+
+	newKey := bytes.Repeat([]byte{0x02}, 16)
+	if err := s.RotateEncryptionKey(newKey); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+
+	item, err := s.Get(schema.Key{Key: []byte("k1")})
+	if err != nil {
+		t.Fatalf("get after rotation: %v", err)
+	}
+	if !bytes.Equal(item.Value, []byte("v1")) {
+		t.Fatalf("unexpected value after rotation: %q", item.Value)
+	}
+
+	if !bytes.Equal(s.encryptionKey, newKey) {
+		t.Fatal("store.encryptionKey was not updated to the new key")
+	}
+
+	if _, err := s.Set(schema.KeyValue{Key: []byte("k2"), Value: []byte("v2")}); err != nil {
+		t.Fatalf("write after rotation: %v", err)
+	}
+}
+
+// TestRotateEncryptionKey_NoDeadlockWithInFlightAsyncCommit reproduces the
+// shape of an async-commit write: t.wg is incremented before the commit
+// callback runs, and the callback needs t.tree.Lock (to call tree.Commit)
+// before calling t.wg.Done. RotateEncryptionKey must wait on t.wg before
+// taking t.tree.Lock itself, or this in-flight "commit" can never finish and
+// RotateEncryptionKey blocks forever.
+func TestRotateEncryptionKey_NoDeadlockWithInFlightAsyncCommit(t *testing.T) {
+	s := newTestStoreForRotation(t)
+
+	s.wg.Add(1)
+	release := make(chan struct{})
+	go func() {
+		<-release
+		s.tree.Lock()
+		s.tree.Unlock()
+		s.wg.Done()
+	}()
+
+	rotated := make(chan error, 1)
+	go func() {
+		rotated <- s.RotateEncryptionKey(bytes.Repeat([]byte{0x02}, 16))
+	}()
+
+	// give RotateEncryptionKey time to reach t.wg.Wait() before releasing
+	// the simulated in-flight commit.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-rotated:
+		if err != nil {
+			t.Fatalf("rotate: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RotateEncryptionKey deadlocked waiting on an in-flight async commit")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+)
+
+// KeySource abstracts where the active encryption key comes from, so Store
+// can be handed a key read from a file, an env var, or fetched from an
+// external KMS, without caring which.
+type KeySource interface {
+	// Key returns the currently active encryption key. ctx may be nil when
+	// called during option building, before a Store exists.
+	Key(ctx context.Context) ([]byte, error)
+}
+
+// StaticKeySource returns a fixed, in-memory key. Useful for tests or when
+// the key is already available to the process (e.g. injected by an
+// orchestrator as a file mounted from a secret store).
+type StaticKeySource struct {
+	key []byte
+}
+
+// NewStaticKeySource wraps key, which must already be 16, 24 or 32 bytes
+// long to select AES-128/192/256.
+func NewStaticKeySource(key []byte) StaticKeySource {
+	return StaticKeySource{key: key}
+}
+
+func (s StaticKeySource) Key(ctx context.Context) ([]byte, error) {
+	return s.key, nil
+}
+
+// FileKeySource reads the key from a file on every call to Key. Store calls
+// Key only when it is opened, so a key written to the file later is not
+// used by an already open Store.
+type FileKeySource struct {
+	path string
+}
+
+// NewFileKeySource reads the encryption key from the file at path.
+func NewFileKeySource(path string) FileKeySource {
+	return FileKeySource{path: path}
+}
+
+func (s FileKeySource) Key(ctx context.Context) ([]byte, error) {
+	return ioutil.ReadFile(s.path)
+}
+
+// EnvKeySource reads the key from an environment variable.
+type EnvKeySource struct {
+	name string
+}
+
+// NewEnvKeySource reads the encryption key from the env var name.
+func NewEnvKeySource(name string) EnvKeySource {
+	return EnvKeySource{name: name}
+}
+
+func (s EnvKeySource) Key(ctx context.Context) ([]byte, error) {
+	v, ok := os.LookupEnv(s.name)
+	if !ok {
+		return nil, ErrMissingEncryptionKey
+	}
+	return []byte(v), nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticKeySource(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	src := NewStaticKeySource(key)
+
+	got, err := src.Key(nil)
+	if err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Fatalf("got %q, want %q", got, key)
+	}
+}
+
+func TestFileKeySource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte("file-key-material"), 0600); err != nil {
+		t.Fatalf("seed key file: %v", err)
+	}
+
+	src := NewFileKeySource(path)
+	got, err := src.Key(nil)
+	if err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	if !bytes.Equal(got, []byte("file-key-material")) {
+		t.Fatalf("got %q, want %q", got, "file-key-material")
+	}
+}
+
+func TestFileKeySource_MissingFile(t *testing.T) {
+	src := NewFileKeySource(filepath.Join(t.TempDir(), "does-not-exist"))
+	if _, err := src.Key(nil); err == nil {
+		t.Fatal("expected an error reading a missing key file")
+	}
+}
+
+func TestEnvKeySource(t *testing.T) {
+	t.Setenv("STORE_TEST_ENCRYPTION_KEY", "env-key-material")
+
+	src := NewEnvKeySource("STORE_TEST_ENCRYPTION_KEY")
+	got, err := src.Key(nil)
+	if err != nil {
+		t.Fatalf("Key: %v", err)
+	}
+	if !bytes.Equal(got, []byte("env-key-material")) {
+		t.Fatalf("got %q, want %q", got, "env-key-material")
+	}
+}
+
+func TestEnvKeySource_Missing(t *testing.T) {
+	src := NewEnvKeySource("STORE_TEST_ENCRYPTION_KEY_NOT_SET")
+	if _, err := src.Key(nil); err != ErrMissingEncryptionKey {
+		t.Fatalf("expected ErrMissingEncryptionKey, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/codenotary/immudb/pkg/logger"
+	"github.com/dgraph-io/badger/v2"
+)
+
+// schemaVersionKey lives under the same tsPrefix-reserved namespace as the
+// tree's own bookkeeping keys, so it's never visible through the regular
+// Get/Set/History API and can't collide with user data.
+var schemaVersionKey = []byte{tsPrefix, 0xFF}
+
+// currentSchemaVersion is the layout version this build of the store
+// expects on disk; Open runs every registered Migration between whatever
+// is stored at schemaVersionKey and this value.
+const currentSchemaVersion = 2
+
+// migrationBatchSize bounds how many mutations a single migration commit
+// carries, so a migration over a multi-GB store doesn't build up one
+// unbounded transaction (and isn't lost wholesale on error, since only the
+// current batch is discarded).
+const migrationBatchSize = 10_000
+
+// Migration upgrades the on-disk layout from Version-1 to Version. Up must
+// be safe to re-run against a DB that already errored out mid-migration
+// (it should pick up where migrationProgressKey(Version) left off rather
+// than redoing completed batches), since Open does not attempt rollback.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(db *badger.DB, tree *treeStore) error
+}
+
+var migrations []Migration
+
+func registerMigration(m Migration) {
+	migrations = append(migrations, m)
+}
+
+func init() {
+	registerMigration(Migration{
+		Version: 1,
+		Name:    "reencode-legacy-tree-keys",
+		Up:      migrateLegacyTreeKeys,
+	})
+	registerMigration(Migration{
+		Version: 2,
+		Name:    "rebuild-reference-index",
+		Up:      migrateRebuildReferenceIndex,
+	})
+}
+
+// migrationProgressKey reserves a per-migration slot to record the last key
+// successfully committed, so a migration interrupted partway through (crash,
+// disk full, ...) resumes from there on the next Open instead of redoing
+// batches that already landed.
+func migrationProgressKey(version int) []byte {
+	return []byte{tsPrefix, 0xFE, byte(version)}
+}
+
+// readSchemaVersion returns the layout version recorded in db, or 0 if the
+// DB predates this subsystem (in which case migrations starting at 1 run).
+func readSchemaVersion(db *badger.DB) (int, error) {
+	var version int
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(schemaVersionKey)
+		if err == badger.ErrKeyNotFound {
+			version = 0
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			version = int(binary.BigEndian.Uint64(val))
+			return nil
+		})
+	})
+	return version, err
+}
+
+func writeSchemaVersion(db *badger.DB, version int) error {
+	txn := db.NewTransactionAt(math.MaxUint64, true)
+	defer txn.Discard()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(version))
+	if err := txn.SetEntry(&badger.Entry{Key: schemaVersionKey, Value: buf}); err != nil {
+		return err
+	}
+	return txn.CommitAt(math.MaxUint64, nil)
+}
+
+func readProgress(db *badger.DB, key []byte) ([]byte, error) {
+	var progress []byte
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			progress = append([]byte{}, val...)
+			return nil
+		})
+	})
+	return progress, err
+}
+
+func writeProgress(db *badger.DB, key, lastKey []byte) error {
+	txn := db.NewTransactionAt(math.MaxUint64, true)
+	defer txn.Discard()
+	if err := txn.SetEntry(&badger.Entry{Key: key, Value: lastKey}); err != nil {
+		return err
+	}
+	return txn.CommitAt(math.MaxUint64, nil)
+}
+
+func clearProgress(db *badger.DB, key []byte) error {
+	txn := db.NewTransactionAt(math.MaxUint64, true)
+	defer txn.Discard()
+	if err := txn.Delete(key); err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	return txn.CommitAt(math.MaxUint64, nil)
+}
+
+// runMigrations brings db from its recorded schema version up to
+// currentSchemaVersion, running each pending Migration in order under an
+// exclusive lock held by the caller (Open holds t.Lock for the whole call).
+// When dryRun is true, nothing is written: each pending migration's Name and
+// target Version is logged and readSchemaVersion is left untouched.
+func runMigrations(db *badger.DB, tree *treeStore, log logger.Logger, dryRun bool) error {
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	from, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.Version <= from {
+			continue
+		}
+		if m.Version > currentSchemaVersion {
+			break
+		}
+		if dryRun {
+			log.Infof("migration %d (%s) would run", m.Version, m.Name)
+			continue
+		}
+		log.Infof("running migration %d (%s)", m.Version, m.Name)
+		if err := m.Up(db, tree); err != nil {
+			return err
+		}
+		if err := writeSchemaVersion(db, m.Version); err != nil {
+			return err
+		}
+		if err := clearProgress(db, migrationProgressKey(m.Version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkInBatches applies visit to every item matched by opts, committing
+// every migrationBatchSize mutated entries through a fresh managed
+// transaction instead of accumulating the whole keyspace in one txn. After
+// each commit it records the last key seen under progressKey, and resumes
+// from just past that key on the next call - so a migration interrupted
+// partway through a multi-GB store picks up where it left off rather than
+// redoing (or losing) everything on retry.
+func walkInBatches(db *badger.DB, opts badger.IteratorOptions, progressKey []byte, visit func(txn *badger.Txn, item *badger.Item) (changed bool, err error)) error {
+	resumeKey, err := readProgress(db, progressKey)
+	if err != nil {
+		return err
+	}
+
+	for {
+		txn := db.NewTransactionAt(math.MaxUint64, true)
+		it := txn.NewIterator(opts)
+
+		if resumeKey != nil {
+			it.Seek(resumeKey)
+			if it.Valid() && bytes.Equal(it.Item().KeyCopy(nil), resumeKey) {
+				it.Next() // already committed in a previous batch
+			}
+		} else {
+			it.Rewind()
+		}
+
+		var lastKey []byte
+		mutated := 0
+		for ; it.Valid() && mutated < migrationBatchSize; it.Next() {
+			item := it.Item()
+			changed, verr := visit(txn, item)
+			if verr != nil {
+				it.Close()
+				txn.Discard()
+				return verr
+			}
+			lastKey = item.KeyCopy(nil)
+			if changed {
+				mutated++
+			}
+		}
+		hasMore := it.Valid()
+		it.Close()
+
+		if lastKey == nil {
+			txn.Discard()
+			return nil // nothing left in the keyspace past resumeKey
+		}
+
+		if err := txn.CommitAt(math.MaxUint64, nil); err != nil {
+			return err
+		}
+		if err := writeProgress(db, progressKey, lastKey); err != nil {
+			return err
+		}
+
+		if !hasMore {
+			return nil
+		}
+		resumeKey = lastKey
+	}
+}
+
+// migrateLegacyTreeKeys re-encodes tree keys written before decodeRefTreeKey
+// gained its current framing, so old stores can be read by the current
+// itemAt/GetTree code paths without falling into ErrObsoleteDataFormat.
+func migrateLegacyTreeKeys(db *badger.DB, tree *treeStore) error {
+	opts := badger.IteratorOptions{Prefix: []byte{tsPrefix}}
+	return walkInBatches(db, opts, migrationProgressKey(1), func(txn *badger.Txn, item *badger.Item) (bool, error) {
+		key := item.KeyCopy(nil)
+		if len(key) < 2 || key[1] >= 0xF0 { // skip our own reserved keys (schema version, progress markers)
+			return false, nil
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return false, err
+		}
+
+		if _, _, err := decodeRefTreeKey(val); err == nil {
+			return false, nil // already in the current format
+		}
+
+		reencoded, err := reencodeLegacyTreeValue(val)
+		if err != nil {
+			return false, err
+		}
+		if err := txn.SetEntry(&badger.Entry{Key: key, Value: reencoded}); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// reencodeLegacyTreeValue upgrades a bare hash+refkey pair written before
+// the refkey carried an explicit length prefix into the current framing
+// expected by decodeRefTreeKey: hash, then a 2-byte big-endian refkey
+// length, then the refkey itself (empty for nodes that never had one).
+func reencodeLegacyTreeValue(val []byte) ([]byte, error) {
+	if len(val) < sha256.Size {
+		return nil, ErrObsoleteDataFormat
+	}
+	hash := val[:sha256.Size]
+	refkey := val[sha256.Size:]
+
+	buf := make([]byte, sha256.Size+2+len(refkey))
+	copy(buf, hash)
+	binary.BigEndian.PutUint16(buf[sha256.Size:], uint16(len(refkey)))
+	copy(buf[sha256.Size+2:], refkey)
+	return buf, nil
+}
+
+// migrateRebuildReferenceIndex walks every entry missing bitReferenceEntry
+// in its UserMeta and, for the ones that actually look like a pre-bit
+// reference row, restores the bit. An entry only qualifies when its value is
+// byte-identical to another key genuinely present in the store (the shape
+// Reference/ZAdd always write); ordinary values that happen to be non-empty
+// are left untouched; otherwise every plain entry in the store would be
+// rewritten - and, since the store keeps every version forever
+// (NumVersionsToKeep = math.MaxInt64), given a phantom extra version on
+// every single upgrade.
+func migrateRebuildReferenceIndex(db *badger.DB, tree *treeStore) error {
+	opts := badger.IteratorOptions{}
+	return walkInBatches(db, opts, migrationProgressKey(2), func(txn *badger.Txn, item *badger.Item) (bool, error) {
+		key := item.KeyCopy(nil)
+		if len(key) > 0 && key[0] == tsPrefix {
+			return false, nil // tree bookkeeping, not user data
+		}
+		if item.UserMeta()&bitReferenceEntry == bitReferenceEntry {
+			return false, nil // already tagged
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return false, err
+		}
+		if !looksLikeLegacyReference(txn, key, val) {
+			return false, nil
+		}
+
+		if err := txn.SetEntry(&badger.Entry{
+			Key:      key,
+			Value:    val,
+			UserMeta: item.UserMeta() | bitReferenceEntry,
+		}); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// looksLikeLegacyReference reports whether key/val has the shape a pre-bit
+// Reference/ZAdd row always had: a value that is itself the byte-identical
+// key of another entry actually present in the store, rather than arbitrary
+// user data that happens to be non-empty.
+func looksLikeLegacyReference(txn *badger.Txn, key, val []byte) bool {
+	if len(val) == 0 || bytes.Equal(val, key) {
+		return false
+	}
+	_, err := txn.Get(val)
+	return err == nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"testing"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// nilLogger is a minimal badger/logger.Logger stub so tests don't depend on
+// a concrete logger implementation.
+type nilLogger struct{}
+
+func (nilLogger) Errorf(string, ...interface{})   {}
+func (nilLogger) Warningf(string, ...interface{}) {}
+func (nilLogger) Infof(string, ...interface{})    {}
+func (nilLogger) Debugf(string, ...interface{})   {}
+
+func openTestDB(t *testing.T) *badger.DB {
+	t.Helper()
+	opt := badger.DefaultOptions(t.TempDir())
+	opt.Logger = nilLogger{}
+	db, err := badger.OpenManaged(opt)
+	if err != nil {
+		t.Fatalf("open test db: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func withMigrations(t *testing.T, ms []Migration) {
+	t.Helper()
+	saved := migrations
+	migrations = ms
+	t.Cleanup(func() { migrations = saved })
+}
+
+func TestRunMigrations_SkipsAlreadyAppliedVersions(t *testing.T) {
+	db := openTestDB(t)
+	if err := writeSchemaVersion(db, 1); err != nil {
+		t.Fatalf("seed schema version: %v", err)
+	}
+
+	var ran []int
+	withMigrations(t, []Migration{
+		{Version: 1, Name: "already-applied", Up: func(*badger.DB, *treeStore) error {
+			ran = append(ran, 1)
+			return nil
+		}},
+		{Version: 2, Name: "pending", Up: func(*badger.DB, *treeStore) error {
+			ran = append(ran, 2)
+			return nil
+		}},
+	})
+
+	if err := runMigrations(db, nil, nilLogger{}, false); err != nil {
+		t.Fatalf("runMigrations: %v", err)
+	}
+
+	if len(ran) != 1 || ran[0] != 2 {
+		t.Fatalf("expected only version 2 to run, got %v", ran)
+	}
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		t.Fatalf("readSchemaVersion: %v", err)
+	}
+	if version != 2 {
+		t.Fatalf("expected schema version 2, got %d", version)
+	}
+}
+
+func TestRunMigrations_DryRunAppliesNothing(t *testing.T) {
+	db := openTestDB(t)
+
+	var ran []int
+	withMigrations(t, []Migration{
+		{Version: 1, Name: "pending", Up: func(*badger.DB, *treeStore) error {
+			ran = append(ran, 1)
+			return nil
+		}},
+	})
+
+	if err := runMigrations(db, nil, nilLogger{}, true); err != nil {
+		t.Fatalf("runMigrations dry-run: %v", err)
+	}
+
+	if len(ran) != 0 {
+		t.Fatalf("dry-run should not execute migrations, ran %v", ran)
+	}
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		t.Fatalf("readSchemaVersion: %v", err)
+	}
+	if version != 0 {
+		t.Fatalf("dry-run should not persist a schema version, got %d", version)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2019-2020 vChain, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package store
+
+import (
+	"github.com/codenotary/immudb/pkg/logger"
+	"github.com/dgraph-io/badger/v2"
+)
+
+// defaultIndexCacheSize is the Badger index cache size we enable whenever
+// encryption is on, as recommended by Badger when EncryptionKey is set.
+const defaultIndexCacheSize = 100 << 20 // 100MB
+
+// Options groups the knobs needed to open a Store.
+type Options struct {
+	dataDir string
+	log     logger.Logger
+
+	// encryption, nil KeySource means encryption is disabled.
+	keySource KeySource
+
+	// dryRunMigrations, when true, makes Open log which migrations would
+	// run instead of applying them.
+	dryRunMigrations bool
+}
+
+// DefaultOptions returns an Options value with sane defaults for dataDir.
+func DefaultOptions(dataDir string, log logger.Logger) Options {
+	return Options{
+		dataDir: dataDir,
+		log:     log,
+	}
+}
+
+// WithKeySource enables encryption-at-rest, pulling the active key from src.
+// The key length determines the Badger cipher (16/24/32 bytes for
+// AES-128/192/256), as validated by Badger itself when the DB is opened.
+func (o Options) WithKeySource(src KeySource) Options {
+	o.keySource = src
+	return o
+}
+
+// WithDryRunMigrations makes Open log which schema migrations would run
+// against the data directory, without writing anything, so operators can
+// preview an upgrade before committing to it.
+func (o Options) WithDryRunMigrations(dryRun bool) Options {
+	o.dryRunMigrations = dryRun
+	return o
+}
+
+// dataStore builds the badger.Options used to open the managed DB, wiring
+// up encryption when a KeySource has been configured. It errors out rather
+// than opening unencrypted if the KeySource can't produce a key: a nil
+// EncryptionKey is Badger's normal disabled-encryption path, so silently
+// falling back to it on a transient key-source failure would open an
+// operator-configured encrypted store in the clear.
+func (o Options) dataStore() (badger.Options, error) {
+	opt := badger.DefaultOptions(o.dataDir)
+	opt.Logger = o.log
+
+	if o.keySource != nil {
+		key, err := o.keySource.Key(nil)
+		if err != nil {
+			return badger.Options{}, err
+		}
+		opt.EncryptionKey = key
+		opt.IndexCacheSize = defaultIndexCacheSize
+	}
+
+	return opt, nil
+}
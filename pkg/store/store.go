@@ -40,10 +40,17 @@ type Store struct {
 	tree *treeStore
 	wg   sync.WaitGroup
 	log  logger.Logger
+
+	dataDir       string
+	encryptionKey []byte
+	badgerOpts    badger.Options
 }
 
 func Open(options Options) (*Store, error) {
-	opt := options.dataStore()
+	opt, err := options.dataStore()
+	if err != nil {
+		return nil, err
+	}
 	opt.NumVersionsToKeep = math.MaxInt64 // immutability, always keep all data
 
 	db, err := badger.OpenManaged(opt)
@@ -54,12 +61,23 @@ func Open(options Options) (*Store, error) {
 	t := &Store{
 		db: db,
 		// fixme(leogr): cache size could be calculated using db.MaxBatchCount()
-		tree: newTreeStore(db, 750_000, opt.Logger),
-		log:  opt.Logger,
+		tree:          newTreeStore(db, 750_000, opt.Logger),
+		log:           opt.Logger,
+		dataDir:       options.dataDir,
+		encryptionKey: opt.EncryptionKey,
+		badgerOpts:    opt,
 	}
 
 	// fixme(leogr): need to get all keys inserted after the tree width, if any, and replay
 
+	t.Lock()
+	err = runMigrations(t.db, t.tree, t.log, options.dryRunMigrations)
+	t.Unlock()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
 	t.log.Infof("Store opened at path: %s", opt.Dir)
 	return t, nil
 }